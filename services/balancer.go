@@ -0,0 +1,160 @@
+package services
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// conn_state holds the mutable, pointer-stable counters a Balancer needs per
+// connection. It is allocated once in add_service_locked and referenced by
+// client.state, so it stays valid even though service.clients itself is
+// reshuffled by append/remove.
+type conn_state struct {
+	inflight       int32 // in-flight RPCs, maintained by track_inflight_interceptor
+	current_weight int32 // smooth weighted round-robin scratch space
+
+	// maintained by the health_checker; consecutive_failures/successes drive
+	// the Unhealthy/Healthy threshold transitions and last_check (unix nano)
+	// records when this endpoint was last probed.
+	consecutive_failures  int32
+	consecutive_successes int32
+	last_check            int64
+}
+
+// Balancer picks one of a service's live connections for a single RPC.
+// Implementations must be safe for concurrent use.
+type Balancer interface {
+	Pick(svc *service) *client
+}
+
+const (
+	BALANCER_ROUND_ROBIN = "round_robin"
+	BALANCER_RANDOM      = "random"
+	BALANCER_LEAST_CONN  = "least_conn"
+	BALANCER_P2C         = "p2c"
+	BALANCER_WEIGHTED    = "weighted_round_robin"
+)
+
+// new_balancer resolves a Balancer by name, defaulting to round-robin to
+// preserve the pool's original behaviour.
+func new_balancer(name string) Balancer {
+	switch name {
+	case BALANCER_RANDOM:
+		return random_balancer{}
+	case BALANCER_LEAST_CONN:
+		return least_conn_balancer{}
+	case BALANCER_P2C:
+		return p2c_balancer{}
+	case BALANCER_WEIGHTED:
+		return weighted_round_robin_balancer{}
+	default:
+		return round_robin_balancer{}
+	}
+}
+
+// round_robin_balancer is the pool's original strategy, cycling through
+// clients in order.
+type round_robin_balancer struct{}
+
+func (round_robin_balancer) Pick(svc *service) *client {
+	if len(svc.clients) == 0 {
+		return nil
+	}
+	idx := int(atomic.AddUint32(&svc.idx, 1))
+	return &svc.clients[idx%len(svc.clients)]
+}
+
+// random_balancer picks a uniformly random client.
+type random_balancer struct{}
+
+func (random_balancer) Pick(svc *service) *client {
+	if len(svc.clients) == 0 {
+		return nil
+	}
+	return &svc.clients[rand.Intn(len(svc.clients))]
+}
+
+// least_conn_balancer scans every client and picks the one with the fewest
+// in-flight RPCs, tracked via track_inflight_interceptor.
+type least_conn_balancer struct{}
+
+func (least_conn_balancer) Pick(svc *service) *client {
+	if len(svc.clients) == 0 {
+		return nil
+	}
+	best := &svc.clients[0]
+	best_load := atomic.LoadInt32(&best.state.inflight)
+	for i := 1; i < len(svc.clients); i++ {
+		c := &svc.clients[i]
+		if load := atomic.LoadInt32(&c.state.inflight); load < best_load {
+			best, best_load = c, load
+		}
+	}
+	return best
+}
+
+// p2c_balancer implements power-of-two-choices: sample two random clients
+// and keep the one with fewer in-flight RPCs. This approximates
+// least_conn_balancer's quality at O(1) instead of O(n).
+type p2c_balancer struct{}
+
+func (p2c_balancer) Pick(svc *service) *client {
+	n := len(svc.clients)
+	switch n {
+	case 0:
+		return nil
+	case 1:
+		return &svc.clients[0]
+	}
+
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := &svc.clients[i], &svc.clients[j]
+	if atomic.LoadInt32(&a.state.inflight) <= atomic.LoadInt32(&b.state.inflight) {
+		return a
+	}
+	return b
+}
+
+// weighted_round_robin_balancer implements Nginx's smooth weighted
+// round-robin: each pick adds every client's configured weight to its
+// running current_weight, then returns (and debits) whichever client has
+// accumulated the most. Clients with a higher weight come up proportionally
+// more often while still being spread out rather than bursted.
+//
+// The accumulate-select-then-debit sequence below has to run as a single
+// atomic unit, not just its individual field updates: svc.wrr_mu serializes
+// it per service, since get_service only holds an RLock and would otherwise
+// let concurrent Picks interleave mid-sequence and drift/underflow
+// current_weight.
+type weighted_round_robin_balancer struct{}
+
+func (weighted_round_robin_balancer) Pick(svc *service) *client {
+	if len(svc.clients) == 0 {
+		return nil
+	}
+
+	svc.wrr_mu.Lock()
+	defer svc.wrr_mu.Unlock()
+
+	total := int32(0)
+	var best *client
+	for i := range svc.clients {
+		c := &svc.clients[i]
+		w := c.weight
+		if w <= 0 {
+			w = 1
+		}
+		total += int32(w)
+		c.state.current_weight += int32(w)
+		if best == nil || c.state.current_weight > best.state.current_weight {
+			best = c
+		}
+	}
+	best.state.current_weight -= total
+	return best
+}
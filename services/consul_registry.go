@@ -0,0 +1,215 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/gonet2/libs/nsq-logger"
+	consul "github.com/hashicorp/consul/api"
+)
+
+const DEFAULT_CONSUL = "127.0.0.1:8500"
+
+// consul_registry implements Registry against a Consul agent/catalog, for
+// deployments that already run Consul instead of etcd.
+type consul_registry struct {
+	client *consul.Client
+}
+
+func new_consul_registry(o *options) (Registry, error) {
+	cfg := consul.DefaultConfig()
+	if env := os.Getenv("CONSUL_HOST"); env != "" {
+		cfg.Address = env
+	} else {
+		cfg.Address = DEFAULT_CONSUL
+	}
+
+	c, err := consul.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &consul_registry{client: c}, nil
+}
+
+// directory keys look like /backends/<name>/<id>; consul only knows about
+// service names, so the directory's base name is used as the Consul service
+// name and the key's own base name as the Consul service id.
+func (r *consul_registry) Register(key, value string) error {
+	name := filepath.Base(filepath.Dir(key))
+	id := filepath.Base(key)
+	host, port, err := split_host_port(value)
+	if err != nil {
+		return err
+	}
+	return r.client.Agent().ServiceRegister(&consul.AgentServiceRegistration{
+		ID:      id,
+		Name:    name,
+		Address: host,
+		Port:    port,
+	})
+}
+
+func (r *consul_registry) Deregister(key string) error {
+	id := filepath.Base(key)
+	return r.client.Agent().ServiceDeregister(id)
+}
+
+// GetService enumerates the Consul catalog and returns every instance of
+// every service, keyed as /backends/<name>/<id> to match Register's
+// hierarchy. directory (always DEFAULT_SERVICE_PATH in practice) is only
+// used as the prefix for the returned keys; the pool is the one that
+// expects one flat "/backends" directory to contain every service.
+func (r *consul_registry) GetService(directory string) (map[string]string, error) {
+	return consul_list_all(r.client, directory)
+}
+
+// consul_list_all lists every Consul service and its healthy instances,
+// shared by GetService and consul_watcher so both see the same hierarchy.
+func consul_list_all(client *consul.Client, directory string) (map[string]string, error) {
+	names, _, err := client.Catalog().Services(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]string)
+	for name := range names {
+		entries, _, err := client.Health().Service(name, "", true, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			key := directory + "/" + name + "/" + e.Service.ID
+			out[key] = join_host_port(e.Service.Address, e.Service.Port)
+		}
+	}
+	return out, nil
+}
+
+func (r *consul_registry) GetValue(key string) (string, error) {
+	kv, _, err := r.client.KV().Get(key, nil)
+	if err != nil {
+		return "", err
+	}
+	if kv == nil {
+		return "", fmt.Errorf("services: key not found: %v", key)
+	}
+	return string(kv.Value), nil
+}
+
+func (r *consul_registry) Watch(directory string) (Watcher, error) {
+	w := &consul_watcher{client: r.client, directory: directory, stop: make(chan struct{})}
+	return w, nil
+}
+
+// consul_watcher blocks on Consul's catalog index (which advances whenever
+// any service or instance changes) and, on wake, re-lists every service via
+// consul_list_all and diffs against the previous snapshot to synthesize
+// add/delete Events. This is coarser than watching one service's health
+// endpoint, but it's what lets the watcher notice services that didn't
+// exist yet when it started.
+type consul_watcher struct {
+	client    *consul.Client
+	directory string
+	last_idx  uint64
+	known     map[string]string
+	stop      chan struct{}
+}
+
+func (w *consul_watcher) Next() (*Event, error) {
+	for {
+		opts := &consul.QueryOptions{WaitIndex: w.last_idx, WaitTime: 30 * time.Second}
+		_, meta, err := w.client.Catalog().Services(opts)
+		if err != nil {
+			return nil, err
+		}
+		w.last_idx = meta.LastIndex
+
+		cur, err := consul_list_all(w.client, w.directory)
+		if err != nil {
+			return nil, err
+		}
+
+		if w.known == nil {
+			w.known = cur
+			continue
+		}
+
+		for key, value := range cur {
+			if w.known[key] != value {
+				w.known[key] = value
+				return &Event{Type: EventAdd, Key: key, Value: value}, nil
+			}
+		}
+		for key := range w.known {
+			if _, ok := cur[key]; !ok {
+				delete(w.known, key)
+				return &Event{Type: EventDelete, Key: key}, nil
+			}
+		}
+
+		select {
+		case <-w.stop:
+			return nil, os_err_closed
+		default:
+		}
+	}
+}
+
+func (w *consul_watcher) Stop() {
+	close(w.stop)
+	log.Tracef("consul watcher stopped: %v", w.directory)
+}
+
+// WatchValue streams changes to a single KV key, such as DEFAULT_NAME_FILE,
+// using a blocking KV().Get query the same way consul_watcher blocks on
+// Catalog().Services().
+func (r *consul_registry) WatchValue(key string) (Watcher, error) {
+	return &consul_kv_watcher{client: r.client, key: key, stop: make(chan struct{})}, nil
+}
+
+type consul_kv_watcher struct {
+	client   *consul.Client
+	key      string
+	last_idx uint64
+	known    string
+	seen     bool
+	stop     chan struct{}
+}
+
+func (w *consul_kv_watcher) Next() (*Event, error) {
+	for {
+		opts := &consul.QueryOptions{WaitIndex: w.last_idx, WaitTime: 30 * time.Second}
+		kv, meta, err := w.client.KV().Get(w.key, opts)
+		if err != nil {
+			return nil, err
+		}
+		w.last_idx = meta.LastIndex
+
+		if kv == nil {
+			if w.seen {
+				w.seen = false
+				return &Event{Type: EventDelete, Key: w.key}, nil
+			}
+			continue
+		}
+
+		value := string(kv.Value)
+		if !w.seen || value != w.known {
+			w.seen = true
+			w.known = value
+			return &Event{Type: EventAdd, Key: w.key, Value: value}, nil
+		}
+
+		select {
+		case <-w.stop:
+			return nil, os_err_closed
+		default:
+		}
+	}
+}
+
+func (w *consul_kv_watcher) Stop() {
+	close(w.stop)
+}
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/gonet2/libs/nsq-logger"
+	clientv3 "go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+// DEFAULT_LEASE_TTL is the liveness lease granted to anything this process
+// registers itself; the lease is kept alive for as long as the process runs,
+// so a crash or network partition lets the key expire on its own.
+const DEFAULT_LEASE_TTL = 10 * time.Second
+
+// etcd_registry is the default Registry, backed by etcd v3's clientv3 KV,
+// lease and watch APIs.
+type etcd_registry struct {
+	client *clientv3.Client
+
+	mu     sync.Mutex
+	leases map[string]clientv3.LeaseID
+}
+
+func new_etcd_registry(o *options) (Registry, error) {
+	machines := o.etcd_machines
+	if len(machines) == 0 {
+		machines = []string{DEFAULT_ETCD}
+		if env := os.Getenv("ETCD_HOST"); env != "" {
+			machines = strings.Split(env, ";")
+		}
+	}
+
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   machines,
+		DialTimeout: DEFAULT_DIAL_TIMEOUT,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcd_registry{client: c, leases: make(map[string]clientv3.LeaseID)}, nil
+}
+
+// Register advertises key=value under a lease and keeps the lease alive for
+// as long as this process is up; if the process dies the key expires on its
+// own instead of lingering as a stale endpoint.
+func (r *etcd_registry) Register(key, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_DIAL_TIMEOUT)
+	defer cancel()
+
+	lease, err := r.client.Grant(ctx, int64(DEFAULT_LEASE_TTL/time.Second))
+	if err != nil {
+		return err
+	}
+	if _, err := r.client.Put(ctx, key, value, clientv3.WithLease(lease.ID)); err != nil {
+		return err
+	}
+
+	keepalive, err := r.client.KeepAlive(context.Background(), lease.ID)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range keepalive {
+			// drain; the client library sends the keepalive requests itself
+			// and delivers their responses on this channel, we only need to
+			// keep it flowing
+		}
+		log.Tracef("lease expired, no longer keeping alive: %v", key)
+	}()
+
+	r.mu.Lock()
+	r.leases[key] = lease.ID
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *etcd_registry) Deregister(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_DIAL_TIMEOUT)
+	defer cancel()
+
+	r.mu.Lock()
+	leaseID, ok := r.leases[key]
+	delete(r.leases, key)
+	r.mu.Unlock()
+
+	if ok {
+		_, err := r.client.Revoke(ctx, leaseID)
+		return err
+	}
+	_, err := r.client.Delete(ctx, key)
+	return err
+}
+
+func (r *etcd_registry) GetService(directory string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_DIAL_TIMEOUT)
+	defer cancel()
+
+	resp, err := r.client.Get(ctx, directory, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	return kvs_to_services(directory, resp.Kvs), nil
+}
+
+func (r *etcd_registry) GetValue(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_DIAL_TIMEOUT)
+	defer cancel()
+
+	resp, err := r.client.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", os.ErrNotExist
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// Watch seeds an etcd_watcher with the current revision so resuming after a
+// broken stream never silently misses events: every watch, including the
+// first, starts from an explicit revision rather than "now".
+func (r *etcd_registry) Watch(directory string) (Watcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := r.client.Get(ctx, directory, clientv3.WithPrefix())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	w := &etcd_watcher{
+		client:    r.client,
+		directory: directory,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	w.start(resp.Header.Revision + 1)
+	return w, nil
+}
+
+// etcd_watcher wraps a clientv3.WatchChan, tracking the last observed
+// revision so a dropped stream resumes exactly where it left off, and
+// reconciling against a fresh list on compaction instead of giving up.
+type etcd_watcher struct {
+	client    *clientv3.Client
+	directory string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	ch        clientv3.WatchChan
+	rev       int64
+	pending   []*Event // events of the last watch response not yet returned by Next
+}
+
+func (w *etcd_watcher) start(rev int64) {
+	w.rev = rev
+	w.ch = w.client.Watch(w.ctx, w.directory, clientv3.WithPrefix(), clientv3.WithRev(rev))
+}
+
+// resync re-lists the whole directory and resumes watching from the
+// revision of that listing, reporting the fresh snapshot back to the caller
+// so it can reconcile its in-memory services map.
+func (w *etcd_watcher) resync() (*Event, error) {
+	resp, err := w.client.Get(w.ctx, w.directory, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	w.start(resp.Header.Revision + 1)
+	return &Event{Type: EventSync, Snapshot: kvs_to_services(w.directory, resp.Kvs)}, nil
+}
+
+func (w *etcd_watcher) Next() (*Event, error) {
+	for {
+		if len(w.pending) > 0 {
+			ev := w.pending[0]
+			w.pending = w.pending[1:]
+			return ev, nil
+		}
+		wresp, ok := <-w.ch
+		if !ok {
+			if w.ctx.Err() != nil {
+				// Stop() was called; the cancellation is what closed w.ch.
+				return nil, os_err_closed
+			}
+			// The stream closed on its own (e.g. the etcd server dropped the
+			// connection) with no error, so there's no compaction to resync
+			// from: just re-establish the watch from the last revision we
+			// actually observed, after a short backoff so a persistently
+			// unreachable etcd doesn't get hammered.
+			log.Warningf("etcd watch channel closed unexpectedly on %v, re-watching from rev %v", w.directory, w.rev)
+			time.Sleep(RETRY_DELAY)
+			w.start(w.rev)
+			continue
+		}
+		if err := wresp.Err(); err != nil {
+			if errors.Is(err, rpctypes.ErrCompacted) {
+				log.Warningf("etcd watch compacted on %v, resyncing", w.directory)
+				return w.resync()
+			}
+			return nil, err
+		}
+
+		w.rev = wresp.Header.Revision + 1
+		for _, ev := range wresp.Events {
+			key := string(ev.Kv.Key)
+			if ev.Type == clientv3.EventTypeDelete {
+				w.pending = append(w.pending, &Event{Type: EventDelete, Key: key})
+				continue
+			}
+			w.pending = append(w.pending, &Event{Type: EventAdd, Key: key, Value: string(ev.Kv.Value)})
+		}
+	}
+}
+
+func (w *etcd_watcher) Stop() {
+	w.cancel()
+}
+
+// WatchValue streams changes to a single key, such as DEFAULT_NAME_FILE,
+// rather than everything under a service directory.
+func (r *etcd_registry) WatchValue(key string) (Watcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &etcd_value_watcher{client: r.client, key: key, ctx: ctx, cancel: cancel, ch: r.client.Watch(ctx, key)}, nil
+}
+
+// etcd_value_watcher watches one key. Unlike etcd_watcher it has no
+// Snapshot/reconcile story: on compaction it just resumes from "now", since
+// every change event carries the key's full value. A change made between the
+// compaction and the new watch is not reported until the key changes again.
+type etcd_value_watcher struct {
+	client *clientv3.Client
+	key    string
+	ctx    context.Context
+	cancel context.CancelFunc
+	ch     clientv3.WatchChan
+}
+
+func (w *etcd_value_watcher) Next() (*Event, error) {
+	for {
+		wresp, ok := <-w.ch
+		if !ok {
+			return nil, os_err_closed
+		}
+		if err := wresp.Err(); err != nil {
+			if errors.Is(err, rpctypes.ErrCompacted) {
+				log.Warningf("etcd watch compacted on %v, resuming from now", w.key)
+				w.ch = w.client.Watch(w.ctx, w.key)
+				continue
+			}
+			return nil, err
+		}
+
+		for _, ev := range wresp.Events {
+			if ev.Type == clientv3.EventTypeDelete {
+				return &Event{Type: EventDelete, Key: w.key}, nil
+			}
+			return &Event{Type: EventAdd, Key: w.key, Value: string(ev.Kv.Value)}, nil
+		}
+	}
+}
+
+func (w *etcd_value_watcher) Stop() {
+	w.cancel()
+}
+
+// kvs_to_services turns a flat clientv3 listing into the key/value map
+// service_pool expects, skipping leaves directly under directory (such as
+// DEFAULT_NAME_FILE) and reserved per-service metadata keys (such as
+// "<service_name>/_meta", see meta_key_suffix), neither of which are service
+// entries.
+func kvs_to_services(directory string, kvs []*mvccpb.KeyValue) map[string]string {
+	out := make(map[string]string)
+	for _, kv := range kvs {
+		key := string(kv.Key)
+		if filepath.Dir(key) == directory {
+			continue
+		}
+		if filepath.Base(key) == meta_key_suffix {
+			continue
+		}
+		out[key] = string(kv.Value)
+	}
+	return out
+}
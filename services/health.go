@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	log "github.com/gonet2/libs/nsq-logger"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	DEFAULT_HEALTH_CHECK_INTERVAL = 15 * time.Second
+	DEFAULT_UNHEALTHY_THRESHOLD   = 3
+	DEFAULT_HEALTHY_THRESHOLD     = 2
+
+	// sustained_unhealthy_multiplier: once an endpoint has racked up this
+	// many multiples of UnhealthyThreshold consecutive failures it is
+	// assumed dead rather than merely flaky, and is closed and removed
+	// instead of being left quarantined.
+	sustained_unhealthy_multiplier = 3
+)
+
+// health_checker periodically issues grpc_health_v1.Health/Check against
+// every known endpoint, so a dead backend is routed around well before its
+// registry entry (if it ever does) expires or gets deleted.
+type health_checker struct {
+	pool                *service_pool
+	interval            time.Duration
+	unhealthy_threshold int32
+	healthy_threshold   int32
+}
+
+func (p *service_pool) start_health_checker(o *options) {
+	h := &health_checker{
+		pool:                p,
+		interval:            o.health_check_interval,
+		unhealthy_threshold: int32(o.unhealthy_threshold),
+		healthy_threshold:   int32(o.healthy_threshold),
+	}
+	go h.run()
+}
+
+func (h *health_checker) run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.check_all()
+	}
+}
+
+// health_target is a single endpoint snapshotted out from under the pool's
+// lock so the actual RPC probe never blocks add_service/get_service.
+type health_target struct {
+	service_name string
+	quarantined  bool
+	c            client
+}
+
+func (h *health_checker) check_all() {
+	h.pool.RLock()
+	var targets []health_target
+	for name, svc := range h.pool.services {
+		for _, c := range svc.clients {
+			targets = append(targets, health_target{service_name: name, c: c})
+		}
+		for _, c := range svc.quarantined {
+			targets = append(targets, health_target{service_name: name, quarantined: true, c: c})
+		}
+	}
+	h.pool.RUnlock()
+
+	for _, t := range targets {
+		h.check_one(t)
+	}
+}
+
+func (h *health_checker) check_one(t health_target) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval/2)
+	defer cancel()
+
+	resp, err := grpc_health_v1.NewHealthClient(t.c.conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	atomic.StoreInt64(&t.c.state.last_check, time.Now().UnixNano())
+
+	if err == nil && resp.GetStatus() == grpc_health_v1.HealthCheckResponse_SERVING {
+		atomic.StoreInt32(&t.c.state.consecutive_failures, 0)
+		successes := atomic.AddInt32(&t.c.state.consecutive_successes, 1)
+		if t.quarantined && successes >= h.healthy_threshold {
+			h.pool.recover(t.service_name, t.c.key)
+		}
+		return
+	}
+
+	atomic.StoreInt32(&t.c.state.consecutive_successes, 0)
+	failures := atomic.AddInt32(&t.c.state.consecutive_failures, 1)
+	switch {
+	case failures >= h.unhealthy_threshold*sustained_unhealthy_multiplier:
+		log.Warningf("endpoint %v failed %v consecutive health checks, evicting: %v", t.c.key, failures, err)
+		h.pool.remove_service(t.c.key)
+	case !t.quarantined && failures >= h.unhealthy_threshold:
+		log.Warningf("endpoint %v failed %v consecutive health checks, quarantined: %v", t.c.key, failures, err)
+		h.pool.quarantine(t.service_name, t.c.key)
+	}
+}
+
+// quarantine moves a client out of service.clients (so get_service and
+// get_service_with_id stop offering it) and into service.quarantined, where
+// it keeps being health-checked until it either recovers or is evicted.
+func (p *service_pool) quarantine(service_name, key string) {
+	p.Lock()
+	defer p.Unlock()
+	svc := p.services[service_name]
+	if svc == nil {
+		return
+	}
+	for i, c := range svc.clients {
+		if c.key == key {
+			svc.clients = append(svc.clients[:i], svc.clients[i+1:]...)
+			svc.quarantined = append(svc.quarantined, c)
+			p.update_endpoint_metrics(service_name)
+			return
+		}
+	}
+}
+
+// recover moves a quarantined client back into service.clients once it has
+// passed HealthyThreshold consecutive checks.
+func (p *service_pool) recover(service_name, key string) {
+	p.Lock()
+	defer p.Unlock()
+	svc := p.services[service_name]
+	if svc == nil {
+		return
+	}
+	for i, c := range svc.quarantined {
+		if c.key == key {
+			svc.quarantined = append(svc.quarantined[:i], svc.quarantined[i+1:]...)
+			svc.clients = append(svc.clients, c)
+			p.update_endpoint_metrics(service_name)
+			log.Tracef("endpoint %v recovered, back in rotation", key)
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	log "github.com/gonet2/libs/nsq-logger"
+	"github.com/hashicorp/mdns"
+)
+
+// DEFAULT_MDNS_DOMAIN is the zeroconf domain backends are advertised under;
+// a service named <name> is advertised as _<name>._backends._tcp.
+const DEFAULT_MDNS_DOMAIN = "_backends._tcp"
+
+// mdns_registry discovers services via multicast DNS on the local network,
+// with no central registry process required.
+//
+// Unlike the etcd/consul registries, mdns supports exactly one flat service
+// per directory: GetService/Watch query _<name>._backends._tcp directly
+// using directory's base name as <name>, with no catalog of service types to
+// enumerate the way Consul's Catalog().Services() does. Pointing this
+// registry at DEFAULT_SERVICE_PATH ("/backends", a directory meant to hold
+// many differently-named services) will not discover anything useful;
+// it only works when every client is configured with RegistryName("mdns")
+// against a directory equal to the single service it wants to reach.
+type mdns_registry struct {
+	servers map[string]*mdns.Server
+}
+
+func new_mdns_registry(o *options) (Registry, error) {
+	log.Warning("mdns registry supports exactly one flat service per directory, not a multi-service /backends hierarchy")
+	return &mdns_registry{servers: make(map[string]*mdns.Server)}, nil
+}
+
+func (r *mdns_registry) Register(key, value string) error {
+	name := filepath.Base(filepath.Dir(key))
+	id := filepath.Base(key)
+	host, port, err := split_host_port(value)
+	if err != nil {
+		return err
+	}
+
+	service, err := mdns.NewMDNSService(id, "_"+name+"."+DEFAULT_MDNS_DOMAIN, "", "", port, nil, []string{host})
+	if err != nil {
+		return err
+	}
+	server, err := mdns.NewServer(&mdns.Config{Zone: service})
+	if err != nil {
+		return err
+	}
+	r.servers[key] = server
+	return nil
+}
+
+func (r *mdns_registry) Deregister(key string) error {
+	server, ok := r.servers[key]
+	if !ok {
+		return nil
+	}
+	delete(r.servers, key)
+	return server.Shutdown()
+}
+
+// GetService looks up the single service named by directory's base name;
+// see the mdns_registry doc comment for why this can't enumerate multiple
+// service names the way the etcd/consul backends do.
+func (r *mdns_registry) GetService(directory string) (map[string]string, error) {
+	name := filepath.Base(directory)
+	entries := make(chan *mdns.ServiceEntry, 16)
+	done := make(chan struct{})
+	out := make(map[string]string)
+
+	go func() {
+		for e := range entries {
+			key := directory + "/" + e.Name
+			out[key] = join_host_port(e.AddrV4.String(), e.Port)
+		}
+		close(done)
+	}()
+
+	err := mdns.Lookup("_"+name+"."+DEFAULT_MDNS_DOMAIN, entries)
+	close(entries)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetValue has no natural mDNS equivalent (there is no shared key/value
+// store on the LAN), so the name whitelist file is simply unsupported here.
+func (r *mdns_registry) GetValue(key string) (string, error) {
+	return "", fmt.Errorf("services: mdns registry does not support GetValue(%v)", key)
+}
+
+// WatchValue has no natural mDNS equivalent either, for the same reason as
+// GetValue: there is no shared key/value store to watch.
+func (r *mdns_registry) WatchValue(key string) (Watcher, error) {
+	return nil, fmt.Errorf("services: mdns registry does not support WatchValue(%v)", key)
+}
+
+// Watch streams changes for the single service named by directory's base
+// name, for the same reason GetService can't cover multiple service names.
+func (r *mdns_registry) Watch(directory string) (Watcher, error) {
+	name := filepath.Base(directory)
+	w := &mdns_watcher{registry: r, directory: directory, name: name, stop: make(chan struct{}), known: make(map[string]string)}
+	return w, nil
+}
+
+// mdns_watcher periodically re-runs mdns.Lookup and diffs against the
+// previous snapshot, since mDNS has no native long-lived watch primitive.
+type mdns_watcher struct {
+	registry  *mdns_registry
+	directory string
+	name      string
+	known     map[string]string
+	stop      chan struct{}
+}
+
+func (w *mdns_watcher) Next() (*Event, error) {
+	for {
+		select {
+		case <-w.stop:
+			return nil, os_err_closed
+		case <-time.After(5 * time.Second):
+		}
+
+		cur, err := w.registry.GetService(w.directory)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		for key, value := range cur {
+			if w.known[key] != value {
+				w.known[key] = value
+				return &Event{Type: EventAdd, Key: key, Value: value}, nil
+			}
+		}
+		for key := range w.known {
+			if _, ok := cur[key]; !ok {
+				delete(w.known, key)
+				return &Event{Type: EventDelete, Key: key}, nil
+			}
+		}
+	}
+}
+
+func (w *mdns_watcher) Stop() {
+	close(w.stop)
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metric_known_services = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "services",
+		Name:      "known_services",
+		Help:      "Number of distinct service names currently tracked by the pool.",
+	})
+
+	// state is "healthy" (routable) or "quarantined" (failing health checks).
+	metric_endpoints = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "services",
+		Name:      "endpoints",
+		Help:      "Endpoints per service, partitioned by routing state.",
+	}, []string{"service", "state"})
+
+	// result is "success" or "failure".
+	metric_dial_total = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "services",
+		Name:      "dial_total",
+		Help:      "Dial attempts per service, partitioned by outcome.",
+	}, []string{"service", "result"})
+
+	metric_watcher_reconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "services",
+		Name:      "watcher_reconnects_total",
+		Help:      "Times the registry watch loop had to recover from an error.",
+	})
+
+	// outcome is "hit", "no_service" (unknown path) or "no_endpoint" (known
+	// path, nothing routable).
+	metric_get_service_total = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "services",
+		Name:      "get_service_total",
+		Help:      "GetService calls, partitioned by path and outcome.",
+	}, []string{"path", "outcome"})
+
+	metric_inflight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "services",
+		Name:      "inflight_rpcs",
+		Help:      "In-flight RPCs per endpoint, as tracked by track_inflight_interceptor.",
+	}, []string{"service", "endpoint"})
+)
+
+// update_endpoint_metrics refreshes the endpoints/known_services gauges for
+// service_name. Callers must hold at least a read lock on the pool.
+func (p *service_pool) update_endpoint_metrics(service_name string) {
+	metric_known_services.Set(float64(len(p.services)))
+
+	svc := p.services[service_name]
+	if svc == nil {
+		metric_endpoints.WithLabelValues(service_name, "healthy").Set(0)
+		metric_endpoints.WithLabelValues(service_name, "quarantined").Set(0)
+		return
+	}
+	metric_endpoints.WithLabelValues(service_name, "healthy").Set(float64(len(svc.clients)))
+	metric_endpoints.WithLabelValues(service_name, "quarantined").Set(float64(len(svc.quarantined)))
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/gonet2/libs/nsq-logger"
+	"gopkg.in/yaml.v3"
+)
+
+// name_entry is one whitelisted service, optionally carrying per-service
+// overrides. Name is the only required field; a bare newline-separated
+// names file (the original format) is equivalent to one name_entry per
+// line with no overrides.
+type name_entry struct {
+	Name           string `json:"name" yaml:"name"`
+	Balancer       string `json:"balancer,omitempty" yaml:"balancer,omitempty"`
+	DialTimeout    string `json:"dial_timeout,omitempty" yaml:"dial_timeout,omitempty"`
+	TLSProfile     string `json:"tls_profile,omitempty" yaml:"tls_profile,omitempty"`
+	MaxConnections int    `json:"max_connections,omitempty" yaml:"max_connections,omitempty"`
+}
+
+// name_document is the JSON/YAML shape of DEFAULT_NAME_FILE.
+type name_document struct {
+	Names []name_entry `json:"names" yaml:"names"`
+}
+
+// parse_names_document accepts either a JSON or YAML name_document, or the
+// original plain newline-separated list of names, so existing deployments
+// never have to migrate their names file just to pick up hot-reload.
+func parse_names_document(raw string) ([]name_entry, error) {
+	var doc name_document
+
+	if err := json.Unmarshal([]byte(raw), &doc); err == nil && len(doc.Names) > 0 {
+		return doc.Names, nil
+	}
+	if err := yaml.Unmarshal([]byte(raw), &doc); err == nil && len(doc.Names) > 0 {
+		return doc.Names, nil
+	}
+
+	var entries []name_entry
+	for _, line := range strings.Split(raw, "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			entries = append(entries, name_entry{Name: name})
+		}
+	}
+	return entries, nil
+}
+
+// start_name_watcher performs the initial whitelist load synchronously (so
+// Init callers see the same behaviour as before) and then watches
+// DEFAULT_NAME_FILE for changes in the background, so operators can add or
+// adjust a service without restarting every client.
+func (p *service_pool) start_name_watcher() {
+	p.reload_names()
+	go p.watch_names()
+}
+
+func (p *service_pool) reload_names() {
+	log.Info("reading names:", DEFAULT_NAME_FILE)
+	value, err := p.registry.GetValue(DEFAULT_NAME_FILE)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	// false: this runs before the initial connect_all(DEFAULT_SERVICE_PATH),
+	// which is about to dial every currently-known service anyway — doing it
+	// again here would double-dial every endpoint.
+	p.apply_names_document(value, false)
+}
+
+func (p *service_pool) watch_names() {
+	w, err := p.registry.WatchValue(DEFAULT_NAME_FILE)
+	if err != nil {
+		// Not every backend can watch a single key (mdns has no shared KV
+		// store); the whitelist simply stays at whatever was last loaded.
+		log.Error(err)
+		return
+	}
+
+	for {
+		event, err := w.Next()
+		if err != nil {
+			log.Error(err)
+			metric_watcher_reconnects.Inc()
+			continue
+		}
+		if event.Type == EventDelete {
+			log.Warning("name file deleted, keeping last known whitelist")
+			continue
+		}
+		log.Info("name file changed, reloading whitelist")
+		p.apply_names_document(event.Value, true)
+	}
+}
+
+// apply_names_document atomically swaps known_names/overrides for a freshly
+// parsed document, tears down any service that fell off the whitelist, and
+// (when reconcile is set) connects any service newly added to it. reconcile
+// is false for the synchronous initial load, since init's connect_all call
+// dials every currently-known service right afterwards anyway.
+func (p *service_pool) apply_names_document(raw string, reconcile bool) {
+	entries, err := parse_names_document(raw)
+	if err != nil {
+		log.Errorf("services: malformed name file: %v", err)
+		return
+	}
+
+	new_names := make(map[string]bool, len(entries))
+	new_overrides := make(map[string]name_entry, len(entries))
+	for _, e := range entries {
+		full := DEFAULT_SERVICE_PATH + "/" + strings.TrimSpace(e.Name)
+		new_names[full] = true
+		new_overrides[full] = e
+	}
+
+	p.Lock()
+	var removed, added []string
+	for name := range p.known_names {
+		if !new_names[name] {
+			removed = append(removed, name)
+		}
+	}
+	for name := range new_names {
+		if !p.known_names[name] {
+			added = append(added, name)
+		}
+	}
+	p.known_names = new_names
+	p.overrides = new_overrides
+	p.enable_name_check = true
+
+	for _, name := range removed {
+		svc := p.services[name]
+		if svc == nil {
+			continue
+		}
+		for _, c := range svc.clients {
+			c.conn.Close()
+		}
+		for _, c := range svc.quarantined {
+			c.conn.Close()
+		}
+		delete(p.services, name)
+		log.Infof("service %v removed from whitelist, torn down", name)
+	}
+	for _, name := range removed {
+		p.update_endpoint_metrics(name)
+	}
+	p.Unlock()
+
+	log.Infof("services: name whitelist reloaded, %v services known", len(new_names))
+
+	// A service newly added to the whitelist only gets endpoints from here
+	// on out: the etcd/consul watcher stream only carries future events, and
+	// whatever was registered before this name was allowed already hit (and
+	// was dropped by) the name check in add_service_locked. Without this,
+	// the service would stay empty until its backends happen to re-register.
+	if reconcile && len(added) > 0 {
+		p.connect_added(added)
+	}
+}
+
+// connect_added re-lists DEFAULT_SERVICE_PATH and dials every endpoint
+// belonging to one of the newly-whitelisted service names in added.
+func (p *service_pool) connect_added(added []string) {
+	added_set := make(map[string]bool, len(added))
+	for _, name := range added {
+		added_set[name] = true
+	}
+
+	snapshot, err := p.registry.GetService(DEFAULT_SERVICE_PATH)
+	if err != nil {
+		log.Errorf("services: could not connect newly whitelisted services %v: %v", added, err)
+		return
+	}
+
+	for key, value := range snapshot {
+		if added_set[filepath.Dir(key)] {
+			p.add_service(key, value)
+		}
+	}
+	log.Infof("services: connected newly whitelisted services: %v", added)
+}
+
+// dial_timeout_for returns the DialTimeout override for service_name, or
+// DEFAULT_DIAL_TIMEOUT if it has none or the override doesn't parse.
+func (p *service_pool) dial_timeout_for(service_name string) time.Duration {
+	ov, ok := p.overrides[service_name]
+	if !ok || ov.DialTimeout == "" {
+		return DEFAULT_DIAL_TIMEOUT
+	}
+	d, err := time.ParseDuration(ov.DialTimeout)
+	if err != nil {
+		log.Errorf("services: bad dial_timeout override for %v: %v", service_name, err)
+		return DEFAULT_DIAL_TIMEOUT
+	}
+	return d
+}
+
+// max_connections_for returns the MaxConnections override for service_name
+// (how many parallel grpc.ClientConns to dial per registry key), or 1.
+func (p *service_pool) max_connections_for(service_name string) int {
+	if ov, ok := p.overrides[service_name]; ok && ov.MaxConnections > 0 {
+		return ov.MaxConnections
+	}
+	return 1
+}
@@ -0,0 +1,158 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// EventType describes the kind of change a Watcher observed.
+type EventType int
+
+const (
+	EventAdd EventType = iota
+	EventDelete
+	// EventSync carries a full directory snapshot in place of a single
+	// key/value change, emitted when a watcher cannot resume incrementally
+	// (e.g. after an etcd compaction) and has to reconcile instead.
+	EventSync
+)
+
+// Event is a single notification surfaced by a Watcher. Add/Delete events
+// describe one key; Sync events carry a full Snapshot of the watched
+// directory for the caller to reconcile against.
+type Event struct {
+	Type     EventType
+	Key      string
+	Value    string
+	Snapshot map[string]string
+}
+
+// Watcher streams Events for a single watched directory (Registry.Watch) or
+// key (Registry.WatchValue) until Stop is called.
+// Next blocks until an event is available, the watch fails, or Stop is called,
+// in which case it returns a non-nil error.
+type Watcher interface {
+	Next() (*Event, error)
+	Stop()
+}
+
+// Registry is implemented by a concrete service-discovery backend (etcd, consul,
+// mdns, ...). service_pool talks to whichever backend is configured purely through
+// this interface, so swapping discovery systems never touches add_service,
+// remove_service or watcher.
+type Registry interface {
+	// Register advertises a service instance under key with address value.
+	Register(key, value string) error
+	// Deregister removes a previously registered service instance.
+	Deregister(key string) error
+	// GetService returns the current key/value pairs registered under directory.
+	GetService(directory string) (map[string]string, error)
+	// Watch streams add/delete events for everything under directory, plus
+	// sync events where the backend has to re-list instead (etcd compaction).
+	Watch(directory string) (Watcher, error)
+	// GetValue fetches a single non-service key, such as the name whitelist file.
+	GetValue(key string) (string, error)
+	// WatchValue streams changes to a single non-service key, such as the
+	// name whitelist file. Backends with no shared key/value store (mdns)
+	// return an error; callers should treat that as "no hot-reload
+	// available" rather than fatal.
+	WatchValue(key string) (Watcher, error)
+}
+
+const (
+	REGISTRY_ETCD   = "etcd"
+	REGISTRY_CONSUL = "consul"
+	REGISTRY_MDNS   = "mdns"
+)
+
+// options collects the configuration assembled by Init's Option list.
+type options struct {
+	registry      string
+	etcd_machines []string
+	dial_timeout  time.Duration
+	balancer      string
+
+	health_check_interval time.Duration
+	unhealthy_threshold   int
+	healthy_threshold     int
+
+	// dial_options is keyed by service directory (e.g. "/backends/auth"),
+	// with "" holding the fallback applied when a service has no entry of
+	// its own. Populated by DialOptionsFor/DefaultDialOptions.
+	dial_options map[string][]grpc.DialOption
+
+	// tls_profiles is keyed by profile name (the tls_profile field of a
+	// name_entry), populated by TLSProfile. A service whose name_entry sets
+	// tls_profile picks its DialOptions from here instead of dial_options.
+	tls_profiles map[string][]grpc.DialOption
+
+	tracing_enabled bool
+}
+
+// Option configures the default pool at Init time.
+type Option func(*options)
+
+// RegistryName selects the discovery backend ("etcd", "consul" or "mdns").
+// It overrides the SERVICE_REGISTRY env var when given explicitly.
+func RegistryName(name string) Option {
+	return func(o *options) {
+		o.registry = name
+	}
+}
+
+// EtcdMachines sets the etcd endpoints to dial, overriding ETCD_HOST.
+func EtcdMachines(machines []string) Option {
+	return func(o *options) {
+		o.etcd_machines = machines
+	}
+}
+
+// BalancerName selects the load-balancing strategy used by GetService:
+// "round_robin" (the default), "random", "least_conn", "p2c" or
+// "weighted_round_robin".
+func BalancerName(name string) Option {
+	return func(o *options) {
+		o.balancer = name
+	}
+}
+
+// HealthCheckInterval sets how often every known endpoint is actively
+// probed via grpc_health_v1.Health/Check, instead of relying solely on
+// registry delete events to notice a dead backend.
+func HealthCheckInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.health_check_interval = d
+	}
+}
+
+// UnhealthyThreshold sets how many consecutive failed health checks move an
+// endpoint out of routing rotation.
+func UnhealthyThreshold(n int) Option {
+	return func(o *options) {
+		o.unhealthy_threshold = n
+	}
+}
+
+// HealthyThreshold sets how many consecutive successful health checks bring
+// a quarantined endpoint back into rotation.
+func HealthyThreshold(n int) Option {
+	return func(o *options) {
+		o.healthy_threshold = n
+	}
+}
+
+// new_registry builds the Registry selected by o.registry.
+func new_registry(o *options) (Registry, error) {
+	switch o.registry {
+	case "", REGISTRY_ETCD:
+		return new_etcd_registry(o)
+	case REGISTRY_CONSUL:
+		return new_consul_registry(o)
+	case REGISTRY_MDNS:
+		return new_mdns_registry(o)
+	default:
+		return nil, fmt.Errorf("services: unknown registry %q", o.registry)
+	}
+}
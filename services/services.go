@@ -1,17 +1,17 @@
 package services
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	etcdclient "github.com/coreos/etcd/client"
 	log "github.com/gonet2/libs/nsq-logger"
-	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -24,22 +24,31 @@ const (
 
 // a single connection
 type client struct {
-	key  string
-	conn *grpc.ClientConn
+	key    string
+	conn   *grpc.ClientConn
+	weight int         // from a "host:port|weight=N" registry value, default 1
+	state  *conn_state // load tracked for balancers that pick by load
 }
 
 // a kind of service
 type service struct {
-	clients []client
-	idx     uint32 // for round-robin purpose
+	clients     []client   // healthy (or not-yet-checked) endpoints, eligible for routing
+	quarantined []client   // failed enough consecutive health checks to be excluded from routing
+	idx         uint32     // for round-robin purpose
+	balancer    Balancer   // per-service override from the name file, or nil to use the pool default
+	wrr_mu      sync.Mutex // serializes weighted_round_robin_balancer.Pick's read-modify-write over current_weight
 }
 
 // all services
 type service_pool struct {
 	services          map[string]*service
-	known_names       map[string]bool // store names.txt
+	known_names       map[string]bool       // store names.txt
+	overrides         map[string]name_entry // per-service policy from the name file, keyed like known_names
 	enable_name_check bool
-	client            etcdclient.Client
+	registry          Registry
+	balancer          Balancer
+	opts              *options
+	tls_cache         sync.Map // service_name -> grpc.DialOption, see transport_credentials_for
 	sync.RWMutex
 }
 
@@ -48,122 +57,109 @@ var (
 	once          sync.Once
 )
 
-// Init() ***MUST*** be called before using
-func Init() {
-	once.Do(_default_pool.init)
+// Init() ***MUST*** be called before using. The discovery backend defaults to
+// etcd, overridable via the SERVICE_REGISTRY env var ("etcd", "consul" or
+// "mdns") or explicitly via RegistryName.
+func Init(opts ...Option) {
+	once.Do(func() {
+		_default_pool.init(opts...)
+	})
 }
 
-func (p *service_pool) init() {
-	// etcd client
-	machines := []string{DEFAULT_ETCD}
-	if env := os.Getenv("ETCD_HOST"); env != "" {
-		machines = strings.Split(env, ";")
+func (p *service_pool) init(opts ...Option) {
+	o := &options{
+		registry:              os.Getenv("SERVICE_REGISTRY"),
+		health_check_interval: DEFAULT_HEALTH_CHECK_INTERVAL,
+		unhealthy_threshold:   DEFAULT_UNHEALTHY_THRESHOLD,
+		healthy_threshold:     DEFAULT_HEALTHY_THRESHOLD,
 	}
-
-	println(machines)
-	// init etcd client
-	cfg := etcdclient.Config{
-		Endpoints: machines,
-		Transport: etcdclient.DefaultTransport,
+	for _, opt := range opts {
+		opt(o)
 	}
-	c, err := etcdclient.New(cfg)
+
+	r, err := new_registry(o)
 	if err != nil {
 		log.Critical(err)
 		os.Exit(-1)
 	}
-	p.client = c
+	p.registry = r
+	p.balancer = new_balancer(o.balancer)
+	p.opts = o
 
 	// init
 	p.services = make(map[string]*service)
 	p.known_names = make(map[string]bool)
-	p.load_names()
+	p.overrides = make(map[string]name_entry)
+	p.start_name_watcher()
 	p.connect_all(DEFAULT_SERVICE_PATH)
+	p.start_health_checker(o)
 }
 
-// get stored service name
-func (p *service_pool) load_names() {
-	kAPI := etcdclient.NewKeysAPI(p.client)
-	// get the keys under directory
-	log.Info("reading names:", DEFAULT_NAME_FILE)
-	resp, err := kAPI.Get(context.Background(), DEFAULT_NAME_FILE, nil)
+// connect to all services
+func (p *service_pool) connect_all(directory string) {
+	log.Info("connecting services under:", directory)
+	services, err := p.registry.GetService(directory)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	// validation check
-	if resp.Node.Dir {
-		log.Error("names is not a file")
-		return
-	}
-
-	// split names
-	names := strings.Split(resp.Node.Value, "\n")
-	log.Info("all service names:", names)
-	for _, v := range names {
-		p.known_names[DEFAULT_SERVICE_PATH+"/"+strings.TrimSpace(v)] = true
+	for key, value := range services {
+		p.add_service(key, value)
 	}
+	log.Info("services add complete")
 
-	p.enable_name_check = true
+	go p.watcher(directory)
 }
 
-// connect to all services
-func (p *service_pool) connect_all(directory string) {
-	kAPI := etcdclient.NewKeysAPI(p.client)
-	// get the keys under directory
-	log.Info("connecting services under:", directory)
-	resp, err := kAPI.Get(context.Background(), directory, &etcdclient.GetOptions{Recursive: true})
+// watcher for data change in the registry, driven by generic Registry.Watch events
+func (p *service_pool) watcher(directory string) {
+	w, err := p.registry.Watch(directory)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	// validation check
-	if !resp.Node.Dir {
-		log.Error("not a directory")
-		return
-	}
-
-	for _, node := range resp.Node.Nodes {
-		if node.Dir { // service directory
-			for _, service := range node.Nodes {
-				p.add_service(service.Key, service.Value)
-			}
-		}
-	}
-	log.Info("services add complete")
-
-	go p.watcher()
-}
-
-// watcher for data change in etcd directory
-func (p *service_pool) watcher() {
-	kAPI := etcdclient.NewKeysAPI(p.client)
-	w := kAPI.Watcher(DEFAULT_SERVICE_PATH, &etcdclient.WatcherOptions{Recursive: true})
 	for {
-		resp, err := w.Next(context.Background())
+		event, err := w.Next()
 		if err != nil {
 			log.Error(err)
+			metric_watcher_reconnects.Inc()
+			// A persistent registry outage (Consul/etcd unreachable) would
+			// otherwise spin w.Next() as fast as it returns, hammering the
+			// registry and the log with no chance for it to recover.
+			time.Sleep(RETRY_DELAY)
 			continue
 		}
-		if resp.Node.Dir {
-			continue
-		}
-		key, value := resp.Node.Key, resp.Node.Value
-		if value == "" {
-			log.Tracef("node delete: %v", key)
-			p.remove_service(key)
-		} else {
-			log.Tracef("node add: %v %v", key, value)
-			p.add_service(key, value)
+		switch event.Type {
+		case EventDelete:
+			log.Tracef("node delete: %v", event.Key)
+			p.remove_service(event.Key)
+		case EventAdd:
+			log.Tracef("node add: %v %v", event.Key, event.Value)
+			p.add_service(event.Key, event.Value)
+		case EventSync:
+			log.Tracef("resyncing services under: %v", directory)
+			p.reconcile(directory, event.Snapshot)
 		}
 	}
 }
 
 // add a service
 func (p *service_pool) add_service(key, value string) {
+	// dial_options_for can do registry I/O (an uncached TLS _meta lookup),
+	// so it must resolve before p.Lock(), not under it — otherwise every
+	// get_service reader blocks on that round-trip for as long as it takes
+	// the registry to answer.
+	service_name := filepath.Dir(key)
+	base_opts := p.dial_options_for(service_name)
+
 	p.Lock()
 	defer p.Unlock()
+	p.add_service_locked(key, value, base_opts)
+}
+
+func (p *service_pool) add_service_locked(key, value string, base_opts []grpc.DialOption) {
 	service_name := filepath.Dir(key)
 	// name check
 	if p.enable_name_check && !p.known_names[service_name] {
@@ -174,24 +170,53 @@ func (p *service_pool) add_service(key, value string) {
 	// try new service kind init
 	if p.services[service_name] == nil {
 		p.services[service_name] = &service{}
+		if ov, ok := p.overrides[service_name]; ok && ov.Balancer != "" {
+			p.services[service_name].balancer = new_balancer(ov.Balancer)
+		}
 		log.Tracef("new service type: %v", service_name)
 	}
 
-	// create service connection
+	// create service connection(s); MaxConnections lets one registry key
+	// (one physical endpoint) back more than one grpc.ClientConn, useful for
+	// spreading load across more than one HTTP/2 connection to a hot backend.
 	service := p.services[service_name]
-	if conn, err := grpc.Dial(value, grpc.WithTimeout(DEFAULT_DIAL_TIMEOUT), grpc.WithInsecure()); err == nil {
-		service.clients = append(service.clients, client{key, conn})
-		log.Tracef("service added: %v -- %v", key, value)
-	} else {
-		log.Errorf("did not connect: %v -- %v err: %v", key, value, err)
+	addr, weight := parse_endpoint(value)
+	conn_count := p.max_connections_for(service_name)
+	for i := 0; i < conn_count; i++ {
+		// conn_count>1 dials several conns for the same registry key; give
+		// each its own inflight label, or they'd all write the same gauge
+		// and it would flap to whichever conn's interceptor last ran
+		// instead of reflecting all of them.
+		endpoint_label := key
+		if conn_count > 1 {
+			endpoint_label = fmt.Sprintf("%v#%v", key, i)
+		}
+		state := &conn_state{}
+		dial_opts := append([]grpc.DialOption{grpc.WithTimeout(p.dial_timeout_for(service_name))}, base_opts...)
+		dial_opts = append(dial_opts, track_inflight_interceptor(state, metric_inflight.WithLabelValues(service_name, endpoint_label))...)
+		if p.opts.tracing_enabled {
+			dial_opts = append(dial_opts, tracing_dial_options(service_name)...)
+		}
+		if conn, err := grpc.Dial(addr, dial_opts...); err == nil {
+			service.clients = append(service.clients, client{key: key, conn: conn, weight: weight, state: state})
+			metric_dial_total.WithLabelValues(service_name, "success").Inc()
+			log.Tracef("service added: %v -- %v", key, value)
+		} else {
+			metric_dial_total.WithLabelValues(service_name, "failure").Inc()
+			log.Errorf("did not connect: %v -- %v err: %v", key, value, err)
+		}
 	}
+	p.update_endpoint_metrics(service_name)
 }
 
 // remove a service
 func (p *service_pool) remove_service(key string) {
 	p.Lock()
 	defer p.Unlock()
+	p.remove_service_locked(key)
+}
 
+func (p *service_pool) remove_service_locked(key string) {
 	// check service kind
 	service_name := filepath.Dir(key)
 	service := p.services[service_name]
@@ -199,22 +224,101 @@ func (p *service_pool) remove_service(key string) {
 		log.Tracef("no such service %v", service_name)
 		return
 	}
+	defer p.update_endpoint_metrics(service_name)
+
+	// remove every connection for key (MaxConnections can dial more than one
+	// per registry key), whether currently routable or quarantined
+	removed := remove_client(&service.clients, key)
+	removed += remove_client(&service.quarantined, key)
+	if removed > 0 {
+		log.Tracef("service removed %v (%v connections)", key, removed)
+	}
+}
 
-	// remove a service
-	for k := range service.clients {
-		if service.clients[k].key == key { // deletion
-			service.clients = append(service.clients[:k], service.clients[k+1:]...)
-			log.Tracef("service removed %v", key)
-			return
+// remove_client deletes every client matching key from *clients, closing
+// its conn first, and reports how many it removed.
+func remove_client(clients *[]client, key string) int {
+	kept := (*clients)[:0]
+	removed := 0
+	for _, c := range *clients {
+		if c.key == key {
+			c.conn.Close()
+			removed++
+			continue
 		}
+		kept = append(kept, c)
 	}
+	*clients = kept
+	return removed
+}
+
+// reconcile replaces everything known under directory with snapshot,
+// dialing newly-seen keys and tearing down ones that vanished. It is used to
+// recover from a watcher that could not resume incrementally (e.g. after an
+// etcd compaction) without losing track of endpoints added or removed while
+// the watch was broken.
+func (p *service_pool) reconcile(directory string, snapshot map[string]string) {
+	// Resolve dial options for every service_name that might need dialing
+	// before taking p.Lock(), for the same reason add_service does: this can
+	// hit the registry (an uncached TLS _meta lookup), and must not happen
+	// while every get_service reader is blocked on p.Lock().
+	base_opts := make(map[string][]grpc.DialOption)
+	for key := range snapshot {
+		service_name := filepath.Dir(key)
+		if _, ok := base_opts[service_name]; !ok {
+			base_opts[service_name] = p.dial_options_for(service_name)
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	var stale []string
+	for service_name, svc := range p.services {
+		if filepath.Dir(service_name) != directory {
+			continue
+		}
+		for _, c := range svc.clients {
+			if _, ok := snapshot[c.key]; !ok {
+				stale = append(stale, c.key)
+			}
+		}
+		for _, c := range svc.quarantined {
+			if _, ok := snapshot[c.key]; !ok {
+				stale = append(stale, c.key)
+			}
+		}
+	}
+	for _, key := range stale {
+		p.remove_service_locked(key)
+	}
+
+	for key, value := range snapshot {
+		service_name := filepath.Dir(key)
+		if svc := p.services[service_name]; svc != nil {
+			if client_present(svc.clients, key) || client_present(svc.quarantined, key) {
+				continue
+			}
+		}
+		p.add_service_locked(key, value, base_opts[service_name])
+	}
+}
+
+func client_present(clients []client, key string) bool {
+	for _, c := range clients {
+		if c.key == key {
+			return true
+		}
+	}
+	return false
 }
 
 // provide a specific key for a service, eg:
 // path:/backends/snowflake, id:s1
 //
 // the full cannonical path for this service is:
-// 			/backends/snowflake/s1
+//
+//	/backends/snowflake/s1
 func (p *service_pool) get_service_with_id(path string, id string) *grpc.ClientConn {
 	p.RLock()
 	defer p.RUnlock()
@@ -238,27 +342,60 @@ func (p *service_pool) get_service_with_id(path string, id string) *grpc.ClientC
 	return nil
 }
 
-// get a service in round-robin style
-// especially useful for load-balance with state-less services
+// get a service using the pool's configured Balancer (round-robin by
+// default); especially useful for load-balance with state-less services
 func (p *service_pool) get_service(path string) *grpc.ClientConn {
 	p.RLock()
 	defer p.RUnlock()
 	// check existence
 	service := p.services[path]
 	if service == nil {
+		metric_get_service_total.WithLabelValues(path, "no_service").Inc()
 		return nil
 	}
 
-	if len(service.clients) == 0 {
+	balancer := p.balancer
+	if service.balancer != nil {
+		balancer = service.balancer
+	}
+	c := balancer.Pick(service)
+	if c == nil {
+		metric_get_service_total.WithLabelValues(path, "no_endpoint").Inc()
 		return nil
 	}
+	metric_get_service_total.WithLabelValues(path, "hit").Inc()
+	return c.conn
+}
+
+// get_service_with_retry calls fn against a picked endpoint for path, and on
+// a retryable gRPC error (Unavailable/DeadlineExceeded) picks again through
+// the balancer and tries again, up to attempts times, each bounded by perTry.
+// The new pick is not guaranteed to differ from the endpoint that failed.
+func (p *service_pool) get_service_with_retry(path string, attempts int, perTry time.Duration, fn func(ctx context.Context, conn *grpc.ClientConn) error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		conn := p.get_service(path)
+		if conn == nil {
+			return fmt.Errorf("services: no endpoint available for %v", path)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), perTry)
+		err = fn(ctx, conn)
+		cancel()
+		if err == nil {
+			return nil
+		}
 
-	// get a service in round-robind style,
-	idx := int(atomic.AddUint32(&service.idx, 1))
-	return service.clients[idx%len(service.clients)].conn
+		code := status.Code(err)
+		if code != codes.Unavailable && code != codes.DeadlineExceeded {
+			return err
+		}
+		log.Warningf("retryable error calling %v (attempt %v/%v): %v", path, i+1, attempts, err)
+	}
+	return err
 }
 
-/////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////
 // Wrappers
 func GetService(path string) *grpc.ClientConn {
 	return _default_pool.get_service(path)
@@ -267,3 +404,11 @@ func GetService(path string) *grpc.ClientConn {
 func GetServiceWithId(path string, id string) *grpc.ClientConn {
 	return _default_pool.get_service_with_id(path, id)
 }
+
+// GetServiceWithRetry is like GetService, but invokes fn with the picked
+// connection and, on an Unavailable or DeadlineExceeded error, transparently
+// picks again through the balancer and retries — in the spirit of go-kit's
+// lb.Retry — up to attempts times with a perTry timeout each.
+func GetServiceWithRetry(path string, attempts int, perTry time.Duration, fn func(ctx context.Context, conn *grpc.ClientConn) error) error {
+	return _default_pool.get_service_with_retry(path, attempts, perTry, fn)
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"os"
+
+	log "github.com/gonet2/libs/nsq-logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// meta_key_suffix names the per-service metadata key, e.g.
+// "/backends/auth/_meta". It is not a service endpoint, so registries that
+// flatten a whole directory listing (etcd's kvs_to_services) must skip it.
+const meta_key_suffix = "_meta"
+
+// tls_meta is the per-service TLS profile optionally stored at
+// /backends/<name>/_meta, letting an operator configure credentials for one
+// service apart from the env-var defaults. It is read once per service and
+// cached (see transport_credentials_for), so a later change to it is not
+// picked up by a running client.
+type tls_meta struct {
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server_name"`
+}
+
+// DialOptionsFor registers extra grpc.DialOptions used only when dialing
+// endpoints under service_name (e.g. "/backends/auth"), such as transport
+// credentials or a grpc.WithPerRPCCredentials token provider. It takes
+// precedence over DefaultDialOptions and any env/_meta-derived TLS config.
+func DialOptionsFor(service_name string, opts ...grpc.DialOption) Option {
+	return func(o *options) {
+		if o.dial_options == nil {
+			o.dial_options = make(map[string][]grpc.DialOption)
+		}
+		o.dial_options[service_name] = append(o.dial_options[service_name], opts...)
+	}
+}
+
+// DefaultDialOptions registers grpc.DialOptions applied to any service with
+// no more specific DialOptionsFor entry.
+func DefaultDialOptions(opts ...grpc.DialOption) Option {
+	return DialOptionsFor("", opts...)
+}
+
+// TLSProfile registers a named set of grpc.DialOptions that a service picks
+// up by setting tls_profile: <name> in the name file, instead of baking a
+// fixed service name into DialOptionsFor. Useful when several services share
+// one certificate bundle or credential provider.
+func TLSProfile(name string, opts ...grpc.DialOption) Option {
+	return func(o *options) {
+		if o.tls_profiles == nil {
+			o.tls_profiles = make(map[string][]grpc.DialOption)
+		}
+		o.tls_profiles[name] = append(o.tls_profiles[name], opts...)
+	}
+}
+
+// dial_options_for resolves the DialOptions to use when dialing
+// service_name: the name file's tls_profile override if it names a
+// registered TLSProfile, then an explicit DialOptionsFor entry, then
+// DefaultDialOptions, and only then TLS credentials derived from env vars or
+// the service's etcd _meta key. grpc.WithInsecure() is the final fallback,
+// so clusters that never configure any of this keep working exactly as
+// before.
+func (p *service_pool) dial_options_for(service_name string) []grpc.DialOption {
+	if ov, ok := p.overrides[service_name]; ok && ov.TLSProfile != "" {
+		if opts, ok := p.opts.tls_profiles[ov.TLSProfile]; ok {
+			return opts
+		}
+		log.Errorf("services: %v requests unknown tls_profile %q", service_name, ov.TLSProfile)
+	}
+	if opts, ok := p.opts.dial_options[service_name]; ok {
+		return opts
+	}
+	if opts, ok := p.opts.dial_options[""]; ok {
+		return opts
+	}
+	return []grpc.DialOption{p.transport_credentials_for(service_name)}
+}
+
+// transport_credentials_for resolves TLS credentials for service_name and
+// caches the result in p.tls_cache, since the underlying load_tls_meta does
+// a registry round-trip (GetValue on "<service_name>/_meta") that every
+// caller needs to have already happened before add_service_locked takes
+// p.Lock() — otherwise that round-trip runs once per endpoint dial, and
+// under the pool's write lock, blocking every get_service reader for as
+// long as it takes the registry to answer.
+func (p *service_pool) transport_credentials_for(service_name string) grpc.DialOption {
+	if cached, ok := p.tls_cache.Load(service_name); ok {
+		return cached.(grpc.DialOption)
+	}
+
+	opt := resolve_transport_credentials(p.registry, service_name)
+	p.tls_cache.Store(service_name, opt)
+	return opt
+}
+
+func resolve_transport_credentials(r Registry, service_name string) grpc.DialOption {
+	meta := load_tls_meta(r, service_name)
+	if meta == nil {
+		return grpc.WithInsecure()
+	}
+
+	cfg := &tls.Config{ServerName: meta.ServerName}
+	if meta.CA != "" {
+		pem, err := os.ReadFile(meta.CA)
+		pool := x509.NewCertPool()
+		if err != nil || !pool.AppendCertsFromPEM(pem) {
+			log.Errorf("services: failed to load CA bundle %v for %v: %v", meta.CA, service_name, err)
+			return grpc.WithInsecure()
+		}
+		cfg.RootCAs = pool
+	}
+	if meta.Cert != "" && meta.Key != "" {
+		cert, err := tls.LoadX509KeyPair(meta.Cert, meta.Key)
+		if err != nil {
+			log.Errorf("services: failed to load client cert/key for %v: %v", service_name, err)
+			return grpc.WithInsecure()
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg))
+}
+
+// load_tls_meta resolves TLS config for service_name, preferring the
+// per-service "<service_name>/_meta" registry key over the
+// SERVICE_TLS_CA/SERVICE_TLS_CERT/SERVICE_TLS_KEY env vars. It returns nil
+// when neither source configures anything, meaning dial insecurely.
+func load_tls_meta(r Registry, service_name string) *tls_meta {
+	if value, err := r.GetValue(service_name + "/_meta"); err == nil {
+		var m tls_meta
+		if err := json.Unmarshal([]byte(value), &m); err == nil {
+			return &m
+		}
+		log.Errorf("services: malformed tls meta at %v/_meta", service_name)
+	}
+
+	ca, cert, key := os.Getenv("SERVICE_TLS_CA"), os.Getenv("SERVICE_TLS_CERT"), os.Getenv("SERVICE_TLS_KEY")
+	if ca == "" && cert == "" && key == "" {
+		return nil
+	}
+	return &tls_meta{CA: ca, Cert: cert, Key: key}
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+var tracer = otel.Tracer("github.com/gonet2/libs/services")
+
+// EnableTracing wraps every dial with an OpenTelemetry client interceptor,
+// so RPCs made through pool-returned conns show up as spans tagged with the
+// target service name instead of the pool being a black box end-to-end.
+func EnableTracing() Option {
+	return func(o *options) {
+		o.tracing_enabled = true
+	}
+}
+
+// tracing_dial_options builds a unary+stream interceptor pair that starts a
+// span per RPC with a "rpc.service" attribute set to service_name.
+func tracing_dial_options(service_name string) []grpc.DialOption {
+	unary := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, span := tracer.Start(ctx, method, trace.WithAttributes(attribute.String("rpc.service", service_name)))
+		defer span.End()
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(otelcodes.Error, err.Error())
+		}
+		return err
+	}
+
+	stream := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, span := tracer.Start(ctx, method, trace.WithAttributes(attribute.String("rpc.service", service_name)))
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(otelcodes.Error, err.Error())
+			span.End()
+			return nil, err
+		}
+		tracked := &tracing_tracked_stream{ClientStream: cs, span: span}
+		go tracked.wait_context_done(ctx)
+		return tracked, nil
+	}
+
+	return []grpc.DialOption{grpc.WithChainUnaryInterceptor(unary), grpc.WithChainStreamInterceptor(stream)}
+}
+
+// tracing_tracked_stream ends the span once the wrapped stream finishes,
+// since a streaming call outlives the interceptor call that created it.
+// RecvMsg only observes a terminal error on streams the caller drains to
+// completion; a bidi/client-streaming caller that stops reading before that
+// (but still ends the RPC) never trips it, so wait_context_done backstops on
+// the RPC context itself being done, or the span would never End.
+type tracing_tracked_stream struct {
+	grpc.ClientStream
+	span trace.Span
+	done int32
+}
+
+func (s *tracing_tracked_stream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil && atomic.CompareAndSwapInt32(&s.done, 0, 1) {
+		if err != io.EOF {
+			s.span.RecordError(err)
+			s.span.SetStatus(otelcodes.Error, err.Error())
+		}
+		s.span.End()
+	}
+	return err
+}
+
+func (s *tracing_tracked_stream) wait_context_done(ctx context.Context) {
+	<-ctx.Done()
+	if atomic.CompareAndSwapInt32(&s.done, 0, 1) {
+		if err := ctx.Err(); err != nil && err != context.Canceled {
+			s.span.RecordError(err)
+			s.span.SetStatus(otelcodes.Error, err.Error())
+		}
+		s.span.End()
+	}
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+// os_err_closed is returned by a Watcher's Next once Stop has been called.
+var os_err_closed = errors.New("services: watcher stopped")
+
+// split_host_port parses a "host:port" address into its parts for backends
+// (consul, mdns) that register host and port separately rather than as a
+// single dial string.
+func split_host_port(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+// join_host_port is the inverse of split_host_port.
+func join_host_port(host string, port int) string {
+	return fmt.Sprintf("%v:%v", host, port)
+}
+
+// parse_endpoint splits a registry value into its dial address and optional
+// metadata, e.g. "10.0.0.1:9000|weight=3" for weighted_round_robin_balancer.
+// Unknown or malformed metadata is ignored rather than rejected, so plain
+// "host:port" values keep working unchanged.
+func parse_endpoint(value string) (addr string, weight int) {
+	weight = 1
+	parts := strings.SplitN(value, "|", 2)
+	addr = parts[0]
+	if len(parts) != 2 {
+		return addr, weight
+	}
+
+	for _, field := range strings.Split(parts[1], ";") {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok || k != "weight" {
+			continue
+		}
+		if w, err := strconv.Atoi(v); err == nil && w > 0 {
+			weight = w
+		}
+	}
+	return addr, weight
+}
+
+// track_inflight_interceptor returns a pair of gRPC dial options that keep
+// state.inflight (for balancers, e.g. least_conn, p2c, that pick by load
+// rather than by turn) and the services_inflight_rpcs gauge in sync with the
+// number of in-progress RPCs on a connection.
+func track_inflight_interceptor(state *conn_state, gauge prometheus.Gauge) []grpc.DialOption {
+	adjust := func(delta int32) {
+		gauge.Set(float64(atomic.AddInt32(&state.inflight, delta)))
+	}
+
+	unary := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		adjust(1)
+		defer adjust(-1)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	stream := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		adjust(1)
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			adjust(-1)
+			return nil, err
+		}
+		tracked := &inflight_tracking_stream{ClientStream: cs, adjust: adjust}
+		go tracked.wait_context_done(ctx)
+		return tracked, nil
+	}
+	return []grpc.DialOption{grpc.WithChainUnaryInterceptor(unary), grpc.WithChainStreamInterceptor(stream)}
+}
+
+// inflight_tracking_stream decrements the in-flight count once the wrapped
+// stream finishes, since a streaming call stays in flight well past the
+// interceptor call that created it. RecvMsg only observes a terminal error on
+// streams the caller drains to completion; a bidi/client-streaming caller
+// that stops reading before that (but still ends the RPC) never trips it, so
+// wait_context_done backstops on the RPC context itself being done.
+type inflight_tracking_stream struct {
+	grpc.ClientStream
+	adjust func(int32)
+	done   int32
+}
+
+func (s *inflight_tracking_stream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil && atomic.CompareAndSwapInt32(&s.done, 0, 1) {
+		s.adjust(-1)
+	}
+	return err
+}
+
+func (s *inflight_tracking_stream) wait_context_done(ctx context.Context) {
+	<-ctx.Done()
+	if atomic.CompareAndSwapInt32(&s.done, 0, 1) {
+		s.adjust(-1)
+	}
+}